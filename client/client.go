@@ -0,0 +1,155 @@
+// Package client keeps a single govmomi session alive across scrape
+// cycles instead of logging in from scratch every time, and centralizes
+// the TLS configuration used to reach vCenter.
+package client
+
+import (
+    "context"
+    "crypto/tls"
+    "crypto/x509"
+    "fmt"
+    "net/http"
+    "net/url"
+    "os"
+    "sync"
+    "time"
+
+    "github.com/vmware/govmomi"
+    "github.com/vmware/govmomi/session"
+    "github.com/vmware/govmomi/vim25"
+    "github.com/vmware/govmomi/vim25/methods"
+    "github.com/vmware/govmomi/vim25/soap"
+)
+
+// TLSConfig controls how the factory's HTTP transport validates vCenter's
+// certificate.
+type TLSConfig struct {
+    CAFile             string
+    CertFile           string
+    KeyFile            string
+    InsecureSkipVerify bool
+}
+
+// Factory hands out a live, authenticated govmomi.Client, re-logging in
+// transparently when the underlying session has expired.
+type Factory struct {
+    vcURL        *url.URL
+    tlsCfg       TLSConfig
+    checkTimeout time.Duration
+
+    mu     sync.Mutex
+    client *govmomi.Client
+}
+
+// NewFactory returns a Factory that logs into vcURL on first use. checkTimeout
+// bounds how long each session liveness check (GetCurrentTime) is allowed to
+// take before the factory assumes the session is dead and re-logs in.
+func NewFactory(vcURL *url.URL, tlsCfg TLSConfig, checkTimeout time.Duration) *Factory {
+    return &Factory{vcURL: vcURL, tlsCfg: tlsCfg, checkTimeout: checkTimeout}
+}
+
+// GetClient returns a live govmomi.Client, logging in if this is the first
+// call or re-authenticating if the existing session has gone stale.
+func (f *Factory) GetClient(ctx context.Context) (*govmomi.Client, error) {
+    f.mu.Lock()
+    defer f.mu.Unlock()
+
+    if f.client == nil {
+        c, err := f.login(ctx)
+        if err != nil {
+            return nil, err
+        }
+        f.client = c
+        return f.client, nil
+    }
+
+    checkCtx, cancel := context.WithTimeout(ctx, f.checkTimeout)
+    defer cancel()
+
+    if _, err := methods.GetCurrentTime(checkCtx, f.client.Client); err != nil {
+        c, err := f.login(ctx)
+        if err != nil {
+            return nil, fmt.Errorf("re-authenticating after stale session: %w", err)
+        }
+        f.client = c
+    }
+
+    return f.client, nil
+}
+
+// login builds a soap.Client with the configured TLS transport *before*
+// connecting, so CAFile/CertFile/KeyFile are already in effect for the TLS
+// handshake that NewClient and Login perform, then logs in explicitly via
+// the session manager.
+func (f *Factory) login(ctx context.Context) (*govmomi.Client, error) {
+    transport, err := transportWithTLS(f.tlsCfg)
+    if err != nil {
+        return nil, fmt.Errorf("building TLS transport: %w", err)
+    }
+
+    soapClient := soap.NewClient(f.vcURL, f.tlsCfg.InsecureSkipVerify)
+    soapClient.Transport = transport
+
+    vimClient, err := vim25.NewClient(ctx, soapClient)
+    if err != nil {
+        return nil, fmt.Errorf("creating vSphere client: %w", err)
+    }
+
+    c := &govmomi.Client{Client: vimClient}
+
+    sm := session.NewManager(vimClient)
+    if err := sm.Login(ctx, f.vcURL.User); err != nil {
+        return nil, fmt.Errorf("logging in: %w", err)
+    }
+
+    c.Client.RoundTripper = session.KeepAliveHandler(c.Client.RoundTripper, f.checkTimeout, func(roundTripper soap.RoundTripper) error {
+        _, err := methods.GetCurrentTime(ctx, roundTripper)
+        return err
+    })
+
+    return c, nil
+}
+
+// transportWithTLS builds an *http.Transport configured per tlsCfg, with a
+// raised MaxIdleConnsPerHost so a keepalive exporter loop reuses
+// connections across scrape cycles instead of reconnecting each time.
+func transportWithTLS(tlsCfg TLSConfig) (*http.Transport, error) {
+    transport := &http.Transport{
+        MaxIdleConnsPerHost: 16,
+        TLSClientConfig: &tls.Config{
+            InsecureSkipVerify: tlsCfg.InsecureSkipVerify,
+        },
+    }
+
+    if tlsCfg.CAFile != "" {
+        pool, err := loadCAPool(tlsCfg.CAFile)
+        if err != nil {
+            return nil, err
+        }
+        transport.TLSClientConfig.RootCAs = pool
+    }
+
+    if tlsCfg.CertFile != "" && tlsCfg.KeyFile != "" {
+        cert, err := tls.LoadX509KeyPair(tlsCfg.CertFile, tlsCfg.KeyFile)
+        if err != nil {
+            return nil, fmt.Errorf("loading client keypair: %w", err)
+        }
+        transport.TLSClientConfig.Certificates = []tls.Certificate{cert}
+    }
+
+    return transport, nil
+}
+
+func loadCAPool(caFile string) (*x509.CertPool, error) {
+    pem, err := os.ReadFile(caFile)
+    if err != nil {
+        return nil, fmt.Errorf("reading CA file: %w", err)
+    }
+
+    pool := x509.NewCertPool()
+    if !pool.AppendCertsFromPEM(pem) {
+        return nil, fmt.Errorf("no certificates found in %s", caFile)
+    }
+
+    return pool, nil
+}
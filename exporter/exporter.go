@@ -0,0 +1,242 @@
+// Package exporter turns a one-shot metrics pull into a long-running
+// Prometheus scrape target, re-querying vSphere performance counters at
+// most once per configured interval and exposing them on /metrics.
+package exporter
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "net/http"
+    "sync"
+    "time"
+
+    "github.com/prometheus/client_golang/prometheus"
+    "github.com/prometheus/client_golang/prometheus/promhttp"
+    "github.com/vmware/govmomi"
+    "github.com/vmware/govmomi/performance"
+    "github.com/vmware/govmomi/vim25/types"
+
+    "github.com/handradesanchez/go-govmomi-metrics/filter"
+)
+
+// defaultMetricName is queried whenever no metric filters are configured.
+const defaultMetricName = "cpu.usagemhz.average"
+
+// Entity is a managed object (VM, host, or cluster) to collect counters
+// for.
+type Entity struct {
+    Ref  types.ManagedObjectReference
+    Name string
+}
+
+// Config describes everything the exporter needs to run its scrape loop.
+type Config struct {
+    Client   *govmomi.Client
+    Entities []Entity
+    Filter   filter.Config
+    Interval time.Duration
+}
+
+// Serve starts an HTTP server on addr exposing the configured counters in
+// Prometheus text format until ctx is canceled. Counters are re-queried
+// when a scrape arrives and at least cfg.Interval has passed since the
+// last successful refresh; otherwise the scrape is served the cached
+// samples.
+func Serve(ctx context.Context, addr string, cfg Config) error {
+    e := newExporter(cfg)
+
+    reg := prometheus.NewRegistry()
+    if err := reg.Register(e); err != nil {
+        return fmt.Errorf("registering exporter collector: %w", err)
+    }
+
+    mux := http.NewServeMux()
+    mux.Handle("/metrics", promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))
+
+    srv := &http.Server{Addr: addr, Handler: mux}
+
+    go func() {
+        <-ctx.Done()
+        shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+        defer cancel()
+        srv.Shutdown(shutdownCtx)
+    }()
+
+    if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+        return err
+    }
+    return nil
+}
+
+// exporter implements prometheus.Collector, re-running QueryPerf on demand
+// so every scrape reflects the latest sample within cfg.Interval.
+type exporter struct {
+    cfg Config
+    pm  *performance.Manager
+
+    mu        sync.Mutex
+    lastFetch time.Time
+    samples   []sample
+}
+
+type sample struct {
+    metricName string
+    entityName string
+    instance   string
+    value      float64
+    valueType  prometheus.ValueType
+}
+
+func newExporter(cfg Config) *exporter {
+    return &exporter{
+        cfg: cfg,
+        pm:  performance.NewManager(cfg.Client.Client),
+    }
+}
+
+func (e *exporter) Describe(ch chan<- *prometheus.Desc) {
+    ch <- metricDesc
+}
+
+func (e *exporter) Collect(ch chan<- prometheus.Metric) {
+    e.mu.Lock()
+    if time.Since(e.lastFetch) >= e.cfg.Interval {
+        if samples, err := e.refresh(context.Background()); err == nil {
+            e.samples = samples
+            e.lastFetch = time.Now()
+        }
+    }
+    samples := e.samples
+    e.mu.Unlock()
+
+    for _, s := range samples {
+        ch <- prometheus.MustNewConstMetric(metricDesc, s.valueType, s.value, s.entityName, s.metricName, s.instance)
+    }
+}
+
+var metricDesc = prometheus.NewDesc(
+    "vsphere_performance",
+    "vSphere VM/host performance counter value, scaled to the counter's native unit.",
+    []string{"entity", "metric", "instance"},
+    nil,
+)
+
+func (e *exporter) refresh(ctx context.Context) ([]sample, error) {
+    counterInfo, err := e.pm.CounterInfoByName(ctx)
+    if err != nil {
+        return nil, fmt.Errorf("retrieving counter info: %w", err)
+    }
+
+    counters := selectCounters(counterInfo, e.cfg.Filter.VMMetricInclude, e.cfg.Filter.VMMetricExclude)
+    for name, counter := range selectCounters(counterInfo, e.cfg.Filter.HostMetricInclude, e.cfg.Filter.HostMetricExclude) {
+        counters[name] = counter
+    }
+
+    var querySpecs []types.PerfQuerySpec
+    for _, counter := range counters {
+        for _, ent := range e.cfg.Entities {
+            querySpecs = append(querySpecs, types.PerfQuerySpec{
+                Entity:     ent.Ref,
+                MetricId:   []types.PerfMetricId{{CounterId: counter.Key}},
+                IntervalId: 20,
+                MaxSample:  1,
+            })
+        }
+    }
+
+    if len(querySpecs) == 0 {
+        return nil, nil
+    }
+
+    metrics, err := e.pm.Query(ctx, querySpecs)
+    if err != nil {
+        return nil, fmt.Errorf("querying performance metrics: %w", err)
+    }
+
+    entityNames := make(map[types.ManagedObjectReference]string, len(e.cfg.Entities))
+    for _, ent := range e.cfg.Entities {
+        entityNames[ent.Ref] = ent.Name
+    }
+
+    counterByKey := make(map[int32]types.PerfCounterInfo, len(counterInfo))
+    for _, counter := range counterInfo {
+        counterByKey[counter.Key] = counter
+    }
+
+    var samples []sample
+    for _, baseMetric := range metrics {
+        metric, ok := baseMetric.(*types.PerfEntityMetric)
+        if !ok {
+            continue
+        }
+
+        entityName := entityNames[metric.Entity]
+
+        for _, value := range metric.Value {
+            series, ok := value.(*types.PerfMetricIntSeries)
+            if !ok || len(series.Value) == 0 {
+                continue
+            }
+
+            counter, ok := counterByKey[series.Id.CounterId]
+            if !ok {
+                continue
+            }
+
+            scaled := scaleValue(counter, series.Value[len(series.Value)-1])
+            samples = append(samples, sample{
+                metricName: fmt.Sprintf("%s.%s.%s", counter.GroupInfo.GetElementDescription().Key, counter.NameInfo.GetElementDescription().Key, counter.RollupType),
+                entityName: entityName,
+                instance:   series.Id.Instance,
+                value:      scaled,
+                valueType:  valueTypeFor(counter),
+            })
+        }
+    }
+
+    return samples, nil
+}
+
+// selectCounters narrows counterInfo down to the metrics that should be
+// queried: defaultMetricName alone when no filters are configured,
+// otherwise whatever matches includes/excludes.
+func selectCounters(counterInfo map[string]types.PerfCounterInfo, includes, excludes []string) map[string]types.PerfCounterInfo {
+    if len(includes) == 0 && len(excludes) == 0 {
+        counter, ok := counterInfo[defaultMetricName]
+        if !ok {
+            return map[string]types.PerfCounterInfo{}
+        }
+        return map[string]types.PerfCounterInfo{defaultMetricName: counter}
+    }
+
+    return filter.FilterCounters(counterInfo, includes, excludes)
+}
+
+// scaleValue applies the counter's unit scale so gauges and counters are
+// reported in their natural unit rather than vSphere's internal integer
+// representation.
+func scaleValue(counter types.PerfCounterInfo, raw int64) float64 {
+    value := float64(raw)
+    switch counter.UnitInfo.GetElementDescription().Key {
+    case "kiloBytes", "kiloBytesPerSecond", "megaHertz":
+        return value
+    case "percent":
+        return value / 100
+    default:
+        return value
+    }
+}
+
+// valueTypeFor maps a counter's StatsType to the Prometheus metric type
+// that represents it most accurately: rate and absolute counters are
+// point-in-time readings (gauges), while delta counters accumulate since
+// the last sample (counters).
+func valueTypeFor(counter types.PerfCounterInfo) prometheus.ValueType {
+    switch counter.StatsType {
+    case types.PerfStatsTypeDelta:
+        return prometheus.CounterValue
+    default:
+        return prometheus.GaugeValue
+    }
+}
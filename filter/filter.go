@@ -0,0 +1,73 @@
+// Package filter scopes metric and inventory collection using glob
+// include/exclude patterns, so operators can avoid pulling every counter
+// for every managed object on large vCenters.
+package filter
+
+import (
+    "path"
+
+    "github.com/vmware/govmomi/vim25/types"
+)
+
+// Config holds the glob patterns used to scope a collection run.
+type Config struct {
+    VMMetricInclude   []string
+    VMMetricExclude   []string
+    HostMetricInclude []string
+    HostMetricExclude []string
+    VMInclude         []string
+}
+
+// FilterCounters returns the subset of counterInfo whose full metric name
+// (e.g. "cpu.usagemhz.average") matches at least one include pattern, if
+// any are set, and none of the exclude patterns. Patterns use path.Match
+// glob syntax.
+func FilterCounters(counterInfo map[string]types.PerfCounterInfo, includes, excludes []string) map[string]types.PerfCounterInfo {
+    filtered := make(map[string]types.PerfCounterInfo)
+
+    for name, counter := range counterInfo {
+        if !matchesAny(name, includes, true) {
+            continue
+        }
+        if matchesAny(name, excludes, false) {
+            continue
+        }
+        filtered[name] = counter
+    }
+
+    return filtered
+}
+
+// FilterVMs returns the subset of inventoryPaths matching at least one of
+// patterns. An empty patterns list matches everything.
+func FilterVMs(inventoryPaths []string, patterns []string) []string {
+    if len(patterns) == 0 {
+        return inventoryPaths
+    }
+
+    var filtered []string
+    for _, p := range inventoryPaths {
+        if matchesAny(p, patterns, true) {
+            filtered = append(filtered, p)
+        }
+    }
+
+    return filtered
+}
+
+// matchesAny reports whether name matches any of patterns. When patterns
+// is empty, emptyMatchesAll controls the result: includes default to
+// "match everything" while excludes default to "match nothing".
+func matchesAny(name string, patterns []string, emptyMatchesAll bool) bool {
+    if len(patterns) == 0 {
+        return emptyMatchesAll
+    }
+
+    for _, pattern := range patterns {
+        if ok, err := path.Match(pattern, name); err == nil && ok {
+            return true
+        }
+    }
+
+    return false
+}
@@ -2,17 +2,107 @@ package main
 
 import (
     "context"
+    "errors"
     "fmt"
     "net/url"
     "os"
+    "runtime"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
 
     "github.com/vmware/govmomi"
+    "github.com/vmware/govmomi/find"
+    "github.com/vmware/govmomi/object"
     "github.com/vmware/govmomi/performance"
-    "github.com/vmware/govmomi/view"
+    "github.com/vmware/govmomi/property"
     "github.com/vmware/govmomi/vim25/mo"
     "github.com/vmware/govmomi/vim25/types"
+    "golang.org/x/sync/errgroup"
+
+    vsclient "github.com/handradesanchez/go-govmomi-metrics/client"
+    "github.com/handradesanchez/go-govmomi-metrics/exporter"
+    "github.com/handradesanchez/go-govmomi-metrics/filter"
+    "github.com/handradesanchez/go-govmomi-metrics/metrickind"
+    "github.com/handradesanchez/go-govmomi-metrics/tscache"
+    "github.com/handradesanchez/go-govmomi-metrics/writer"
 )
 
+// sessionCheckTimeout bounds how long the client factory's per-call
+// session liveness check (GetCurrentTime) is allowed to take before it
+// assumes the session is dead and re-authenticates.
+const sessionCheckTimeout = 10 * time.Second
+
+// lookbackSamples bounds how many intervals a query window reaches back
+// before an entity's last recorded collection time, tolerating vCenter's
+// delayed publication of recent samples.
+const lookbackSamples = 3
+
+// defaultBatchSize is the number of entities bundled into a single
+// QueryPerf call. vCenter bounds the number of entities it will accept per
+// request, so very large inventories must be split into batches. Override
+// with QUERY_BATCH_SIZE.
+const defaultBatchSize = 256
+
+// batchSizeFromEnv returns QUERY_BATCH_SIZE parsed as a positive int, or
+// defaultBatchSize if it's unset or invalid.
+func batchSizeFromEnv() int {
+    v := os.Getenv("QUERY_BATCH_SIZE")
+    if v == "" {
+        return defaultBatchSize
+    }
+
+    size, err := strconv.Atoi(v)
+    if err != nil || size <= 0 {
+        fmt.Printf("Invalid QUERY_BATCH_SIZE %q, using default of %d\n", v, defaultBatchSize)
+        return defaultBatchSize
+    }
+    return size
+}
+
+// entity is the subset of a managed object retrieveEntities needs to build
+// a PerfQuerySpec and label the resulting samples. datacenter is derived
+// from inventory path; cluster is derived from a host's inventory path (for
+// VMs, that of the host they run on; for clusters, their own name); host is
+// populated for VMs only, as the name of the host they currently run on.
+type entity struct {
+    ref        types.ManagedObjectReference
+    name       string
+    path       string // inventory path
+    datacenter string
+    cluster    string
+    host       string
+}
+
+// filterConfigFromEnv builds a filter.Config from comma-separated glob
+// lists in VM_METRIC_INCLUDE, VM_METRIC_EXCLUDE, HOST_METRIC_INCLUDE,
+// HOST_METRIC_EXCLUDE, and VM_INCLUDE.
+func filterConfigFromEnv() filter.Config {
+    return filter.Config{
+        VMMetricInclude:   splitEnvList("VM_METRIC_INCLUDE"),
+        VMMetricExclude:   splitEnvList("VM_METRIC_EXCLUDE"),
+        HostMetricInclude: splitEnvList("HOST_METRIC_INCLUDE"),
+        HostMetricExclude: splitEnvList("HOST_METRIC_EXCLUDE"),
+        VMInclude:         splitEnvList("VM_INCLUDE"),
+    }
+}
+
+func splitEnvList(key string) []string {
+    val := os.Getenv(key)
+    if val == "" {
+        return nil
+    }
+
+    var patterns []string
+    for _, p := range strings.Split(val, ",") {
+        if p = strings.TrimSpace(p); p != "" {
+            patterns = append(patterns, p)
+        }
+    }
+    return patterns
+}
+
 func main() {
     // Step 1: Read environment variables
     vc, user, pass := readEnvVars()
@@ -20,16 +110,101 @@ func main() {
     // Step 2: Concatenate https and sdk to the VCSA_SERVER
     vcURL := formatVCURL(vc)
 
-    // Step 3: Create a vSphere client
+    // Step 3: Create a vSphere client factory and get a live client
     ctx, cancel := context.WithCancel(context.Background())
     defer cancel()
-    client := createVSphereClient(ctx, vcURL, user, pass)
 
-    // Step 4: Retrieve VMs
-    vms := retrieveVMs(ctx, client)
+    factory := clientFactory(vcURL, user, pass)
+    client, err := factory.GetClient(ctx)
+    if err != nil {
+        fmt.Printf("Error creating vSphere client: %v\n", err)
+        os.Exit(1)
+    }
+
+    // Step 4: Retrieve VMs, hosts, and clusters, scoped by VM_INCLUDE
+    cfg := filterConfigFromEnv()
+    entities := retrieveEntities(ctx, client, cfg)
+
+    // Step 5: Retrieve and display performance metrics, or run as a
+    // Prometheus exporter if EXPORTER_ADDR is set.
+    if addr := os.Getenv("EXPORTER_ADDR"); addr != "" {
+        runExporter(ctx, addr, client, entities, cfg)
+        return
+    }
+
+    sink := sinkFromEnv()
+    cache := metrickind.NewCache()
+    ts := tscache.New()
+
+    // COLLECT_INTERVAL turns the one-shot print into a daemon that
+    // re-collects on a fixed cadence, sharing cache and ts across cycles
+    // so the lookback window's overlap doesn't duplicate samples at sink.
+    interval, err := time.ParseDuration(os.Getenv("COLLECT_INTERVAL"))
+    if err != nil {
+        retrieveAndDisplayMetrics(ctx, client, entities, cfg, vc, sink, cache, ts)
+        return
+    }
 
-    // Step 5: Retrieve and display VM metrics
-    retrieveAndDisplayMetrics(ctx, client, vms)
+    for {
+        retrieveAndDisplayMetrics(ctx, client, entities, cfg, vc, sink, cache, ts)
+        ts.Expire(time.Now())
+        time.Sleep(interval)
+    }
+}
+
+// sinkFromEnv builds a writer.Sink from WRITER_INFLUX_* environment
+// variables, or returns nil if WRITER_INFLUX_ADDR is unset, in which case
+// samples are only printed to stdout (they are printed either way).
+func sinkFromEnv() writer.Sink {
+    addr := os.Getenv("WRITER_INFLUX_ADDR")
+    if addr == "" {
+        return nil
+    }
+
+    return writer.NewInfluxSink(writer.InfluxConfig{
+        Addr:              addr,
+        Org:               os.Getenv("WRITER_INFLUX_ORG"),
+        Bucket:            os.Getenv("WRITER_INFLUX_BUCKET"),
+        Token:             os.Getenv("WRITER_INFLUX_TOKEN"),
+        MeasurementPrefix: os.Getenv("WRITER_INFLUX_MEASUREMENT_PREFIX"),
+    })
+}
+
+// runExporter serves VM and host performance counters as Prometheus
+// metrics, scoped by the same VMMetricInclude/Exclude and
+// HostMetricInclude/Exclude filters retrieveAndDisplayMetrics uses.
+// Clusters are excluded: the exporter mirrors the request's "VM and host"
+// scope rather than every entity kind retrieveEntities discovers.
+func runExporter(ctx context.Context, addr string, client *govmomi.Client, entities []entity, cfg filter.Config) {
+    var scoped []entity
+    for _, e := range entities {
+        if e.ref.Type == "VirtualMachine" || e.ref.Type == "HostSystem" {
+            scoped = append(scoped, e)
+        }
+    }
+
+    exporterCfg := exporter.Config{
+        Client:   client,
+        Entities: toExporterEntities(scoped),
+        Filter:   cfg,
+        Interval: 20 * time.Second,
+    }
+
+    fmt.Printf("Serving vSphere metrics on %s/metrics\n", addr)
+    if err := exporter.Serve(ctx, addr, exporterCfg); err != nil {
+        fmt.Printf("Error serving metrics: %v\n", err)
+        os.Exit(1)
+    }
+}
+
+// toExporterEntities adapts main's internal entity type to the exporter
+// package's public Entity type.
+func toExporterEntities(entities []entity) []exporter.Entity {
+    out := make([]exporter.Entity, 0, len(entities))
+    for _, e := range entities {
+        out = append(out, exporter.Entity{Ref: e.ref, Name: e.name})
+    }
+    return out
 }
 
 func readEnvVars() (string, string, string) {
@@ -49,49 +224,306 @@ func formatVCURL(vc string) string {
     return fmt.Sprintf("https://%s/sdk", vc)
 }
 
-func createVSphereClient(ctx context.Context, vcURL, user, pass string) *govmomi.Client {
+// clientFactory builds a vsclient.Factory for vcURL, authenticated as
+// user/pass, configured from VCENTER_TLS_* environment variables.
+func clientFactory(vcURL, user, pass string) *vsclient.Factory {
     u, err := url.Parse(vcURL)
     if err != nil {
         fmt.Printf("Error parsing URL: %v\n", err)
         os.Exit(1)
     }
-
     u.User = url.UserPassword(user, pass)
 
-    c, err := govmomi.NewClient(ctx, u, true)
+    return vsclient.NewFactory(u, tlsConfigFromEnv(), sessionCheckTimeout)
+}
+
+// tlsConfigFromEnv builds a vsclient.TLSConfig from VCENTER_TLS_CA_FILE,
+// VCENTER_TLS_CERT_FILE, VCENTER_TLS_KEY_FILE, and
+// VCENTER_TLS_INSECURE_SKIP_VERIFY (defaults to true, matching the
+// tool's original behavior of trusting any vCenter certificate).
+func tlsConfigFromEnv() vsclient.TLSConfig {
+    insecure := true
+    if v := os.Getenv("VCENTER_TLS_INSECURE_SKIP_VERIFY"); v != "" {
+        insecure = v != "false"
+    }
+
+    return vsclient.TLSConfig{
+        CAFile:             os.Getenv("VCENTER_TLS_CA_FILE"),
+        CertFile:           os.Getenv("VCENTER_TLS_CERT_FILE"),
+        KeyFile:            os.Getenv("VCENTER_TLS_KEY_FILE"),
+        InsecureSkipVerify: insecure,
+    }
+}
+
+// retrieveEntities discovers every VM, host, and cluster in the inventory
+// and returns them as a flat list of entities so the same QueryPerf
+// pipeline can collect metrics for all three. VMs are scoped down to
+// cfg.VMInclude, matched against their inventory path. Each entity's
+// datacenter, cluster, and (for VMs) host are resolved here so samples can
+// be tagged with them.
+func retrieveEntities(ctx context.Context, client *govmomi.Client, cfg filter.Config) []entity {
+    var entities []entity
+
+    hosts := retrieveHosts(ctx, client)
+    hostCluster := make(map[types.ManagedObjectReference]string, len(hosts))
+    hostName := make(map[types.ManagedObjectReference]string, len(hosts))
+
+    for _, host := range hosts {
+        ref := host.Reference()
+        cluster := clusterFromHostPath(host.InventoryPath)
+
+        hostCluster[ref] = cluster
+        hostName[ref] = host.Name()
+
+        entities = append(entities, entity{
+            ref:        ref,
+            name:       host.Name(),
+            path:       host.InventoryPath,
+            datacenter: datacenterFromPath(host.InventoryPath),
+            cluster:    cluster,
+        })
+    }
+
+    for _, cluster := range retrieveClusters(ctx, client) {
+        entities = append(entities, entity{
+            ref:        cluster.Reference(),
+            name:       cluster.Name(),
+            path:       cluster.InventoryPath,
+            datacenter: datacenterFromPath(cluster.InventoryPath),
+            cluster:    cluster.Name(),
+        })
+    }
+
+    vms := retrieveVMsByPath(ctx, client, cfg.VMInclude)
+    vmHosts := vmHostRefs(ctx, client, vms)
+
+    for _, vm := range vms {
+        hostRef := vmHosts[vm.Reference()]
+        entities = append(entities, entity{
+            ref:        vm.Reference(),
+            name:       vm.Name(),
+            path:       vm.InventoryPath,
+            datacenter: datacenterFromPath(vm.InventoryPath),
+            cluster:    hostCluster[hostRef],
+            host:       hostName[hostRef],
+        })
+    }
+
+    return entities
+}
+
+// datacenterFromPath returns the first segment of an absolute inventory
+// path, which vSphere always roots at a datacenter (e.g.
+// "/DC0/vm/prod/web1" -> "DC0").
+func datacenterFromPath(invPath string) string {
+    segments := strings.Split(strings.Trim(invPath, "/"), "/")
+    if len(segments) == 0 {
+        return ""
+    }
+    return segments[0]
+}
+
+// clusterFromHostPath returns the cluster name for a host's inventory
+// path, e.g. "/DC0/host/Cluster1/esx1.local" -> "Cluster1". A standalone
+// host (not in a real cluster) has an implicit ComputeResource of the same
+// name as the host, which isn't a cluster worth tagging.
+func clusterFromHostPath(invPath string) string {
+    segments := strings.Split(strings.Trim(invPath, "/"), "/")
+    if len(segments) < 4 {
+        return ""
+    }
+
+    cluster, host := segments[2], segments[3]
+    if cluster == host {
+        return ""
+    }
+    return cluster
+}
+
+// vmHostRefs returns, for each VM, the ManagedObjectReference of the host
+// it currently runs on, so entities can be tagged with their resident
+// host (and, transitively, that host's cluster).
+func vmHostRefs(ctx context.Context, client *govmomi.Client, vms []*object.VirtualMachine) map[types.ManagedObjectReference]types.ManagedObjectReference {
+    if len(vms) == 0 {
+        return nil
+    }
+
+    refs := make([]types.ManagedObjectReference, len(vms))
+    for i, vm := range vms {
+        refs[i] = vm.Reference()
+    }
+
+    var props []mo.VirtualMachine
+    pc := property.DefaultCollector(client.Client)
+    if err := pc.Retrieve(ctx, refs, []string{"runtime.host"}, &props); err != nil {
+        fmt.Printf("Error retrieving VM host references: %v\n", err)
+        return nil
+    }
+
+    hostRefs := make(map[types.ManagedObjectReference]types.ManagedObjectReference, len(props))
+    for _, p := range props {
+        if p.Runtime.Host != nil {
+            hostRefs[p.Reference()] = *p.Runtime.Host
+        }
+    }
+
+    return hostRefs
+}
+
+// retrieveVMsByPath lists every VM in every datacenter via the inventory
+// finder, recursing into subfolders ("...") so VMs nested below the top
+// level (e.g. "/DC0/vm/prod/*") are discovered, then narrows the list down
+// to paths matching includePatterns (matching everything when empty).
+func retrieveVMsByPath(ctx context.Context, client *govmomi.Client, includePatterns []string) []*object.VirtualMachine {
+    f := find.NewFinder(client.Client, true)
+
+    dcs, err := f.DatacenterList(ctx, "*")
     if err != nil {
-        fmt.Printf("Error creating vSphere client: %v\n", err)
+        fmt.Printf("Error listing datacenters: %v\n", err)
         os.Exit(1)
     }
 
-    return c
+    var vms []*object.VirtualMachine
+    for _, dc := range dcs {
+        f.SetDatacenter(dc)
+
+        dcVMs, err := f.VirtualMachineList(ctx, "...")
+        if err != nil {
+            if isNotFound(err) {
+                continue
+            }
+            fmt.Printf("Error listing virtual machines: %v\n", err)
+            os.Exit(1)
+        }
+        vms = append(vms, dcVMs...)
+    }
+
+    paths := make([]string, len(vms))
+    byPath := make(map[string]*object.VirtualMachine, len(vms))
+    for i, vm := range vms {
+        paths[i] = vm.InventoryPath
+        byPath[vm.InventoryPath] = vm
+    }
+
+    var matched []*object.VirtualMachine
+    for _, path := range filter.FilterVMs(paths, includePatterns) {
+        matched = append(matched, byPath[path])
+    }
+
+    return matched
 }
 
-func retrieveVMs(ctx context.Context, client *govmomi.Client) []mo.VirtualMachine {
-    m := view.NewManager(client.Client)
+// isNotFound reports whether err is a find.NotFoundError, which Finder
+// list calls return when a datacenter has no objects of the requested
+// kind. That's expected (e.g. a datacenter with no VMs) and shouldn't
+// abort discovery in the other datacenters.
+func isNotFound(err error) bool {
+    var notFound *find.NotFoundError
+    return errors.As(err, &notFound)
+}
 
-    v, err := m.CreateContainerView(ctx, client.ServiceContent.RootFolder, []string{"VirtualMachine"}, true)
+// retrieveHosts lists every host in every datacenter, recursing into
+// subfolders ("...") so hosts nested below the top level are discovered.
+// Unlike a container view, the inventory finder populates InventoryPath,
+// which callers use to derive each host's datacenter and cluster.
+func retrieveHosts(ctx context.Context, client *govmomi.Client) []*object.HostSystem {
+    f := find.NewFinder(client.Client, true)
+
+    dcs, err := f.DatacenterList(ctx, "*")
     if err != nil {
-        fmt.Printf("Error creating container view: %v\n", err)
+        fmt.Printf("Error listing datacenters: %v\n", err)
         os.Exit(1)
     }
-    defer v.Destroy(ctx)
 
-    var vms []mo.VirtualMachine
-    err = v.Retrieve(ctx, []string{"VirtualMachine"}, []string{"name"}, &vms)
+    var hosts []*object.HostSystem
+    for _, dc := range dcs {
+        f.SetDatacenter(dc)
+
+        dcHosts, err := f.HostSystemList(ctx, "...")
+        if err != nil {
+            if isNotFound(err) {
+                continue
+            }
+            fmt.Printf("Error listing hosts: %v\n", err)
+            os.Exit(1)
+        }
+        hosts = append(hosts, dcHosts...)
+    }
+
+    return hosts
+}
+
+// retrieveClusters lists every cluster in every datacenter, recursing into
+// subfolders ("...") so clusters nested below the top level are
+// discovered.
+func retrieveClusters(ctx context.Context, client *govmomi.Client) []*object.ClusterComputeResource {
+    f := find.NewFinder(client.Client, true)
+
+    dcs, err := f.DatacenterList(ctx, "*")
     if err != nil {
-        fmt.Printf("Error retrieving virtual machines: %v\n", err)
+        fmt.Printf("Error listing datacenters: %v\n", err)
         os.Exit(1)
     }
 
-    return vms
+    var clusters []*object.ClusterComputeResource
+    for _, dc := range dcs {
+        f.SetDatacenter(dc)
+
+        dcClusters, err := f.ClusterComputeResourceList(ctx, "...")
+        if err != nil {
+            if isNotFound(err) {
+                continue
+            }
+            fmt.Printf("Error listing clusters: %v\n", err)
+            os.Exit(1)
+        }
+        clusters = append(clusters, dcClusters...)
+    }
+
+    return clusters
 }
 
-func retrieveAndDisplayMetrics(ctx context.Context, client *govmomi.Client, vms []mo.VirtualMachine) {
-    pm := performance.NewManager(client.Client)
+// defaultMetricName is queried for VMs whenever no VM_METRIC_INCLUDE/EXCLUDE
+// filters are configured, and for hosts and clusters whenever no
+// HOST_METRIC_INCLUDE/EXCLUDE filters are configured, preserving the tool's original out-of-the-box
+// behavior.
+const defaultMetricName = "cpu.usagemhz.average"
+
+// queryWindow is the StartTime/EndTime to use for one entity's
+// PerfQuerySpec in a single collection cycle.
+type queryWindow struct {
+    start, end *time.Time
+}
+
+// computeWindows resolves every entity's query window once per collection
+// cycle, before any QueryPerf calls are made. Query windows must not be
+// recomputed per counter: queryBatch runs one goroutine per (counter,
+// batch), and cache.Window/cache.Advance share state keyed by entity, so
+// interleaving them per counter lets one counter's Advance shrink the
+// window another counter queries moments later, silently dropping that
+// counter's samples for the cycle.
+func computeWindows(entities []entity, cache *metrickind.Cache, now time.Time) map[types.ManagedObjectReference]queryWindow {
+    windows := make(map[types.ManagedObjectReference]queryWindow, len(entities))
+    for _, e := range entities {
+        interval := metrickind.IntervalFor(e.ref.Type)
+        start, end := cache.Window(e.ref, interval, lookbackSamples, now)
+        windows[e.ref] = queryWindow{start: start, end: end}
+    }
+    return windows
+}
 
-    // Define the metric to retrieve
-    metricName := "cpu.usagemhz.average"
+// retrieveAndDisplayMetrics queries entities in batches of
+// batchSizeFromEnv() (defaultBatchSize unless QUERY_BATCH_SIZE is set),
+// dispatching batches across a worker pool bounded by GOMAXPROCS so large
+// inventories don't pay the cost of one QueryPerf round trip per entity.
+// The counters queried for VMs are scoped by cfg.VMMetricInclude/Exclude;
+// those for hosts and clusters by cfg.HostMetricInclude/Exclude.
+// vcenter is the vCenter hostname, used to tag every sample. cache and ts
+// should be reused across repeated calls (see COLLECT_INTERVAL in main) so
+// the per-entity lookback window and the sample dedup it requires both
+// carry state across collection cycles.
+func retrieveAndDisplayMetrics(ctx context.Context, client *govmomi.Client, entities []entity, cfg filter.Config, vcenter string, sink writer.Sink, cache *metrickind.Cache, ts *tscache.TSCache) {
+    pm := performance.NewManager(client.Client)
 
     // Get the performance counter information
     counterInfo, err := pm.CounterInfoByName(ctx)
@@ -100,44 +532,189 @@ func retrieveAndDisplayMetrics(ctx context.Context, client *govmomi.Client, vms
         os.Exit(1)
     }
 
-    counter, ok := counterInfo[metricName]
-    if !ok {
-        fmt.Printf("Metric %s not found\n", metricName)
-        os.Exit(1)
+    vmEntities, hostEntities := partitionByKind(entities)
+
+    groups := []struct {
+        entities []entity
+        counters map[string]types.PerfCounterInfo
+    }{
+        {vmEntities, selectCounters(counterInfo, cfg.VMMetricInclude, cfg.VMMetricExclude)},
+        {hostEntities, selectCounters(counterInfo, cfg.HostMetricInclude, cfg.HostMetricExclude)},
     }
 
-    for _, vm := range vms {
-        query := types.PerfQuerySpec{
-            Entity:     vm.Reference(),
-            MetricId:   []types.PerfMetricId{{CounterId: counter.Key}},
-            IntervalId: 20, // 20 seconds interval
-            MaxSample:  1,
+    now := time.Now()
+    windows := computeWindows(entities, cache, now)
+
+    var (
+        mu      sync.Mutex
+        samples []writer.Sample
+    )
+
+    g, gctx := errgroup.WithContext(ctx)
+    g.SetLimit(runtime.GOMAXPROCS(0))
+
+    batchSize := batchSizeFromEnv()
+    for _, grp := range groups {
+        for metricName, counter := range grp.counters {
+            for _, batch := range chunkEntities(grp.entities, batchSize) {
+                metricName, counter, batch := metricName, counter, batch
+                g.Go(func() error {
+                    batchSamples := queryBatch(gctx, pm, counter, metricName, batch, windows, ts, vcenter)
+
+                    mu.Lock()
+                    samples = append(samples, batchSamples...)
+                    mu.Unlock()
+
+                    return nil
+                })
+            }
         }
+    }
 
-        metrics, err := pm.Query(ctx, []types.PerfQuerySpec{query})
-        if err != nil {
-            fmt.Printf("Error querying performance metrics for VM %s: %v\n", vm.Name, err)
+    if err := g.Wait(); err != nil {
+        fmt.Printf("Error querying performance metrics: %v\n", err)
+    }
+
+    for _, e := range entities {
+        cache.Advance(e.ref, now)
+    }
+
+    if sink != nil {
+        if err := sink.Write(ctx, samples); err != nil {
+            fmt.Printf("Error writing metrics to sink: %v\n", err)
+        }
+    }
+}
+
+// applyEntityIdentity sets the writer.Sample field that identifies e,
+// keyed by entity kind, so a host or cluster sample doesn't land in
+// InfluxDB tagged as a VM.
+func applyEntityIdentity(sample *writer.Sample, e entity) {
+    switch e.ref.Type {
+    case "VirtualMachine":
+        sample.VMName = e.name
+    case "HostSystem":
+        sample.Host = e.name
+    case "ClusterComputeResource":
+        sample.Cluster = e.name
+    }
+}
+
+// partitionByKind splits entities into VMs and everything else (hosts and
+// clusters), so VM and host metric filters can be applied independently.
+func partitionByKind(entities []entity) (vms, hosts []entity) {
+    for _, e := range entities {
+        if e.ref.Type == "VirtualMachine" {
+            vms = append(vms, e)
+        } else {
+            hosts = append(hosts, e)
+        }
+    }
+    return vms, hosts
+}
+
+// selectCounters narrows counterInfo down to the metrics that should be
+// queried: defaultMetricName alone when no filters are configured,
+// otherwise whatever matches includes/excludes.
+func selectCounters(counterInfo map[string]types.PerfCounterInfo, includes, excludes []string) map[string]types.PerfCounterInfo {
+    if len(includes) == 0 && len(excludes) == 0 {
+        counter, ok := counterInfo[defaultMetricName]
+        if !ok {
+            return nil
+        }
+        return map[string]types.PerfCounterInfo{defaultMetricName: counter}
+    }
+
+    return filter.FilterCounters(counterInfo, includes, excludes)
+}
+
+// chunkEntities splits entities into slices of at most size.
+func chunkEntities(entities []entity, size int) [][]entity {
+    var chunks [][]entity
+    for size < len(entities) {
+        entities, chunks = entities[size:], append(chunks, entities[:size:size])
+    }
+    if len(entities) > 0 {
+        chunks = append(chunks, entities)
+    }
+    return chunks
+}
+
+// queryBatch issues a single QueryPerf call covering every entity in batch
+// and returns the samples it produced, printing each one as it's found.
+// windows supplies the StartTime/EndTime to query for each entity,
+// computed once per collection cycle by computeWindows so that one
+// counter's collection can't shrink the window another counter queries in
+// the same cycle. Because that window overlaps the previous one by design
+// (lookbackSamples), ts filters out any sample already emitted for a
+// series.
+func queryBatch(ctx context.Context, pm *performance.Manager, counter types.PerfCounterInfo, metricName string, batch []entity, windows map[types.ManagedObjectReference]queryWindow, ts *tscache.TSCache, vcenter string) []writer.Sample {
+    byRef := make(map[types.ManagedObjectReference]entity, len(batch))
+
+    querySpecs := make([]types.PerfQuerySpec, 0, len(batch))
+    for _, e := range batch {
+        byRef[e.ref] = e
+
+        window := windows[e.ref]
+        querySpecs = append(querySpecs, types.PerfQuerySpec{
+            Entity:     e.ref,
+            MetricId:   []types.PerfMetricId{{CounterId: counter.Key}},
+            IntervalId: metrickind.IntervalFor(e.ref.Type),
+            StartTime:  window.start,
+            EndTime:    window.end,
+        })
+    }
+
+    metrics, err := pm.Query(ctx, querySpecs)
+    if err != nil {
+        fmt.Printf("Error querying performance metrics for batch: %v\n", err)
+        return nil
+    }
+
+    var samples []writer.Sample
+
+    for _, baseMetric := range metrics {
+        metric, ok := baseMetric.(*types.PerfEntityMetric)
+        if !ok {
+            fmt.Println("Error asserting metric type for batch entry")
             continue
         }
 
-        for _, baseMetric := range metrics {
-            metric, ok := baseMetric.(*types.PerfEntityMetric)
+        e := byRef[metric.Entity]
+
+        for _, value := range metric.Value {
+            series, ok := value.(*types.PerfMetricIntSeries)
             if !ok {
-                fmt.Printf("Error asserting metric type for VM %s\n", vm.Name)
+                fmt.Printf("Error asserting metric series type for %s\n", e.name)
                 continue
             }
 
-            for _, value := range metric.Value {
-                series, ok := value.(*types.PerfMetricIntSeries)
-                if !ok {
-                    fmt.Printf("Error asserting metric series type for VM %s\n", vm.Name)
-                    continue
-                }
+            if series.Id.CounterId != counter.Key || len(series.Value) == 0 {
+                continue
+            }
+
+            key := tscache.Key(metric.Entity.Value, metricName, series.Id.Instance)
+            newSampleInfo, newValues := ts.Filter(key, metric.SampleInfo, series.Value)
+
+            for i, s := range newSampleInfo {
+                fmt.Printf("%s (%s): %s = %v\n", e.name, e.ref.Type, metricName, newValues[i])
 
-                if series.Id.CounterId == counter.Key {
-                    fmt.Printf("VM: %s, CPU Usage (MHz): %v\n", vm.Name, series.Value)
+                sample := writer.Sample{
+                    VCenter:    vcenter,
+                    Datacenter: e.datacenter,
+                    Cluster:    e.cluster,
+                    Host:       e.host,
+                    Metric:     metricName,
+                    Instance:   series.Id.Instance,
+                    Value:      float64(newValues[i]),
+                    Timestamp:  s.Timestamp,
                 }
+                applyEntityIdentity(&sample, e)
+
+                samples = append(samples, sample)
             }
         }
     }
+
+    return samples
 }
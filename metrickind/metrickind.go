@@ -0,0 +1,78 @@
+// Package metrickind selects the correct PerfQuerySpec sampling interval
+// and time window for a given entity type. Realtime counters (20s) are
+// only available on hosts and VMs; every other entity (datastores,
+// clusters, resource pools) only supports the historical rollup intervals
+// vCenter is configured with (300s by default).
+package metrickind
+
+import (
+    "sync"
+    "time"
+
+    "github.com/vmware/govmomi/vim25/types"
+)
+
+// Realtime and historical intervals, in seconds, as defined by vCenter's
+// default performance collection levels.
+const (
+    RealtimeInterval       int32 = 20
+    HistoricalInterval5Min int32 = 300
+    HistoricalInterval30Min int32 = 1800
+    HistoricalInterval2Hour int32 = 7200
+    HistoricalInterval1Day  int32 = 86400
+)
+
+// IntervalFor returns the sampling interval to use for entityType, as
+// reported by a ManagedObjectReference's Type field (e.g. "VirtualMachine",
+// "HostSystem", "Datastore", "ClusterComputeResource").
+func IntervalFor(entityType string) int32 {
+    switch entityType {
+    case "VirtualMachine", "HostSystem":
+        return RealtimeInterval
+    default:
+        return HistoricalInterval5Min
+    }
+}
+
+// Cache records the last time each entity was successfully collected, so
+// the next query's StartTime can pick up where the previous one left off.
+// It is safe for concurrent use.
+type Cache struct {
+    mu   sync.Mutex
+    last map[types.ManagedObjectReference]time.Time
+}
+
+// NewCache returns an empty last-collection cache.
+func NewCache() *Cache {
+    return &Cache{last: make(map[types.ManagedObjectReference]time.Time)}
+}
+
+// Window computes the StartTime/EndTime to use for ref's next PerfQuerySpec.
+// StartTime is lookback samples before the entity's last recorded
+// collection time, or before now for an entity not yet collected, so each
+// window overlaps the previous one and tolerates vCenter's delayed
+// publication of recent samples. EndTime is left nil, meaning "now" as far
+// as vCenter is concerned.
+func (c *Cache) Window(ref types.ManagedObjectReference, interval int32, lookback int, now time.Time) (start, end *time.Time) {
+    lookbackDur := time.Duration(interval) * time.Duration(lookback) * time.Second
+
+    c.mu.Lock()
+    last, ok := c.last[ref]
+    c.mu.Unlock()
+
+    from := now
+    if ok {
+        from = last
+    }
+    lookbackStart := from.Add(-lookbackDur)
+
+    return &lookbackStart, nil
+}
+
+// Advance records now as ref's last collection time, so the next Window
+// call starts from here.
+func (c *Cache) Advance(ref types.ManagedObjectReference, now time.Time) {
+    c.mu.Lock()
+    c.last[ref] = now
+    c.mu.Unlock()
+}
@@ -0,0 +1,89 @@
+// Package tscache deduplicates performance samples across overlapping
+// query windows. The realtime/historical interval routing in metrickind
+// deliberately re-requests a lookback of prior samples to tolerate
+// delayed publication in vCenter, which means the same sample can be
+// returned by more than one collection cycle; writing it twice would
+// corrupt a time-series backend that isn't itself idempotent on
+// timestamp.
+package tscache
+
+import (
+    "sync"
+    "time"
+
+    "github.com/vmware/govmomi/vim25/types"
+)
+
+// maxAge bounds how long a series' high-water mark is retained once it
+// stops receiving new samples, so a cache tracking series for entities
+// that are later deleted doesn't grow unbounded.
+const maxAge = time.Hour
+
+// TSCache records, per series, the timestamp of the newest sample it has
+// emitted, and filters out anything at or before that mark on the next
+// collection. It is safe for concurrent use.
+type TSCache struct {
+    mu   sync.RWMutex
+    mark map[string]time.Time
+}
+
+// New returns an empty TSCache.
+func New() *TSCache {
+    return &TSCache{mark: make(map[string]time.Time)}
+}
+
+// Key builds the cache key for one series: an entity, a metric name, and
+// the counter's instance (empty string for the aggregate instance).
+func Key(entityRef, metricName, instance string) string {
+    return entityRef + "|" + metricName + "|" + instance
+}
+
+// Filter returns the subset of samples (and their matching values, by
+// index) whose timestamp is strictly after key's recorded high-water
+// mark, then advances the mark to the newest timestamp seen.
+func (c *TSCache) Filter(key string, samples []types.PerfSampleInfo, values []int64) ([]types.PerfSampleInfo, []int64) {
+    c.mu.RLock()
+    mark := c.mark[key]
+    c.mu.RUnlock()
+
+    var filteredSamples []types.PerfSampleInfo
+    var filteredValues []int64
+    newest := mark
+
+    for i, s := range samples {
+        if i >= len(values) {
+            break
+        }
+        if !s.Timestamp.After(mark) {
+            continue
+        }
+
+        filteredSamples = append(filteredSamples, s)
+        filteredValues = append(filteredValues, values[i])
+
+        if s.Timestamp.After(newest) {
+            newest = s.Timestamp
+        }
+    }
+
+    if newest.After(mark) {
+        c.mu.Lock()
+        c.mark[key] = newest
+        c.mu.Unlock()
+    }
+
+    return filteredSamples, filteredValues
+}
+
+// Expire drops any series whose high-water mark is older than maxAge,
+// bounding the cache's memory to recently active series.
+func (c *TSCache) Expire(now time.Time) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    for key, mark := range c.mark {
+        if now.Sub(mark) > maxAge {
+            delete(c.mark, key)
+        }
+    }
+}
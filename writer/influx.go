@@ -0,0 +1,115 @@
+package writer
+
+import (
+    "bytes"
+    "context"
+    "fmt"
+    "net/http"
+    "strings"
+    "time"
+)
+
+// InfluxConfig configures an InfluxSink.
+type InfluxConfig struct {
+    // Addr is the InfluxDB v2 server, e.g. "https://influx.example.com:8086".
+    Addr   string
+    Org    string
+    Bucket string
+    Token  string
+
+    // MeasurementPrefix is prepended to the metric name to form the
+    // measurement, e.g. prefix "vsphere" + metric "vm.cpu.usagemhz.average"
+    // becomes measurement "vsphere_vm_cpu_usagemhz_average".
+    MeasurementPrefix string
+
+    HTTPClient *http.Client
+}
+
+// InfluxSink writes samples to InfluxDB v2 using the HTTP line protocol
+// write API, batching all samples passed to a single Write call into one
+// request.
+type InfluxSink struct {
+    cfg InfluxConfig
+}
+
+// NewInfluxSink returns a Sink backed by an InfluxDB v2 bucket.
+func NewInfluxSink(cfg InfluxConfig) *InfluxSink {
+    if cfg.HTTPClient == nil {
+        cfg.HTTPClient = &http.Client{Timeout: 10 * time.Second}
+    }
+    return &InfluxSink{cfg: cfg}
+}
+
+func (s *InfluxSink) Write(ctx context.Context, samples []Sample) error {
+    if len(samples) == 0 {
+        return nil
+    }
+
+    var buf bytes.Buffer
+    for _, sample := range samples {
+        buf.WriteString(s.lineProtocol(sample))
+        buf.WriteByte('\n')
+    }
+
+    url := fmt.Sprintf("%s/api/v2/write?org=%s&bucket=%s&precision=s", s.cfg.Addr, s.cfg.Org, s.cfg.Bucket)
+
+    req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, &buf)
+    if err != nil {
+        return fmt.Errorf("building influx write request: %w", err)
+    }
+    req.Header.Set("Authorization", "Token "+s.cfg.Token)
+    req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+
+    resp, err := s.cfg.HTTPClient.Do(req)
+    if err != nil {
+        return fmt.Errorf("writing to influx: %w", err)
+    }
+    defer resp.Body.Close()
+
+    if resp.StatusCode >= 300 {
+        return fmt.Errorf("influx write returned status %s", resp.Status)
+    }
+
+    return nil
+}
+
+func (s *InfluxSink) lineProtocol(sample Sample) string {
+    measurement := escapeMeasurement(s.measurementName(sample.Metric))
+
+    tags := []string{}
+    addTag := func(key, value string) {
+        if value != "" {
+            tags = append(tags, fmt.Sprintf("%s=%s", key, escapeTagValue(value)))
+        }
+    }
+    addTag("vcenter", sample.VCenter)
+    addTag("datacenter", sample.Datacenter)
+    addTag("cluster", sample.Cluster)
+    addTag("host", sample.Host)
+    addTag("vm", sample.VMName)
+    addTag("instance", sample.Instance)
+
+    line := measurement
+    if len(tags) > 0 {
+        line += "," + strings.Join(tags, ",")
+    }
+    line += fmt.Sprintf(" value=%v %d", sample.Value, sample.Timestamp.Unix())
+
+    return line
+}
+
+func (s *InfluxSink) measurementName(metric string) string {
+    name := strings.ReplaceAll(metric, ".", "_")
+    if s.cfg.MeasurementPrefix == "" {
+        return name
+    }
+    return s.cfg.MeasurementPrefix + "_" + name
+}
+
+func escapeMeasurement(s string) string {
+    return strings.NewReplacer(",", "\\,", " ", "\\ ").Replace(s)
+}
+
+func escapeTagValue(s string) string {
+    return strings.NewReplacer(",", "\\,", " ", "\\ ", "=", "\\=").Replace(s)
+}
@@ -0,0 +1,31 @@
+// Package writer defines a pluggable sink for collected vSphere performance
+// samples, so a collection pipeline like retrieveAndDisplayMetrics can push
+// to a time-series backend instead of (or in addition to) printing to
+// stdout.
+package writer
+
+import (
+    "context"
+    "time"
+)
+
+// Sample is one performance counter reading for a single entity, ready to
+// be handed to a Sink.
+type Sample struct {
+    VCenter    string
+    Datacenter string
+    Cluster    string
+    Host       string
+    VMName     string
+    Metric     string
+    Instance   string
+    Value      float64
+    Timestamp  time.Time
+}
+
+// Sink writes a batch of samples to a backend. Implementations should
+// batch internally where the backend benefits from it; Write may be called
+// once per collection cycle with all samples gathered so far.
+type Sink interface {
+    Write(ctx context.Context, samples []Sample) error
+}